@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/spf13/pflag"
+
+	"github.com/vexxhost/migratekit/internal/openstack"
+)
+
+// floatingIPFlags holds the CLI-bound values backing
+// FloatingIPConfigFromFlags. Per-network overrides live on
+// NetworkMapping.FloatingPool rather than here, since they're naturally
+// keyed by the same --network-mapping occurrences.
+type floatingIPFlags struct {
+	enabled     bool
+	defaultPool string
+}
+
+var floatingIPFlagsVar floatingIPFlags
+
+// AddFloatingIPFlags registers the flags that back
+// FloatingIPConfigFromFlags: whether to allocate floating IPs at all, and
+// the default pool to draw them from when a network mapping doesn't name
+// its own via --network-mapping's floating_pool.
+func AddFloatingIPFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(&floatingIPFlagsVar.enabled, "floating-ip", false, "Allocate and associate a floating IP for each migrated instance's ports")
+	flags.StringVar(&floatingIPFlagsVar.defaultPool, "floating-ip-pool", "", "Default floating IP pool (external network name) used when a network mapping doesn't set its own")
+}
+
+// FloatingIPConfigFromFlags builds an openstack.FloatingIPConfig from the
+// flags registered by AddFloatingIPFlags, plus the per-network
+// FloatingPool set on each of networkMappings' entries.
+func FloatingIPConfigFromFlags(networkMappings *NetworkMappingFlag) openstack.FloatingIPConfig {
+	config := openstack.FloatingIPConfig{
+		Enabled:     floatingIPFlagsVar.enabled,
+		DefaultPool: floatingIPFlagsVar.defaultPool,
+	}
+
+	if networkMappings == nil {
+		return config
+	}
+
+	for _, mapping := range networkMappings.Mappings {
+		if mapping.FloatingPool == "" {
+			continue
+		}
+
+		if config.PoolByNetwork == nil {
+			config.PoolByNetwork = make(map[string]string)
+		}
+		config.PoolByNetwork[mapping.NetworkID.String()] = mapping.FloatingPool
+	}
+
+	return config
+}
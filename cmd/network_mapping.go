@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/google/uuid"
+)
+
+// ExtraFixedIP is a secondary fixed IP added to a port beyond its primary
+// address, for VMware guests that were configured with more than one IP on
+// a single NIC.
+type ExtraFixedIP struct {
+	SubnetID  uuid.UUID
+	IPAddress *net.IP
+}
+
+// Subport is a single VLAN leg of a Neutron trunk: the network it attaches
+// to and the 802.1Q segmentation ID carried on the trunk for that VLAN.
+type Subport struct {
+	NetworkID      uuid.UUID
+	SegmentationID int
+}
+
+// TrunkMapping describes the subports of a Neutron trunk whose parent is
+// the port created for a mapping, one subport per VLAN carried by a tagged
+// VMware port group.
+type TrunkMapping struct {
+	Subports []Subport
+}
+
+// NetworkMapping associates a VMware vNIC, keyed by MAC address in
+// NetworkMappingFlag.Mappings, with the Neutron network/subnet/IP it
+// should land on, plus the extra networking features a migrated guest may
+// need: secondary fixed IPs, VRRP/keepalived allowed-address-pairs, a
+// Neutron trunk for tagged VMware port groups, and the floating IP pool
+// this network's ports should draw from (overriding the global default set
+// by --floating-ip-pool).
+type NetworkMapping struct {
+	NetworkID           uuid.UUID
+	SubnetID            uuid.UUID
+	IPAddress           *net.IP
+	ExtraFixedIPs       []ExtraFixedIP
+	AllowedAddressPairs []net.IPNet
+	Trunk               *TrunkMapping
+	FloatingPool        string
+}
+
+// networkMappingJSON is the wire format accepted by NetworkMappingFlag.Set:
+// one JSON object per --network-mapping occurrence, keyed by MAC address.
+type networkMappingJSON struct {
+	MACAddress          string             `json:"mac_address"`
+	NetworkID           string             `json:"network_id"`
+	SubnetID            string             `json:"subnet_id,omitempty"`
+	IPAddress           string             `json:"ip_address,omitempty"`
+	ExtraFixedIPs       []extraFixedIPJSON `json:"extra_fixed_ips,omitempty"`
+	AllowedAddressPairs []string           `json:"allowed_address_pairs,omitempty"`
+	Trunk               *trunkMappingJSON  `json:"trunk,omitempty"`
+	FloatingPool        string             `json:"floating_pool,omitempty"`
+}
+
+type extraFixedIPJSON struct {
+	SubnetID  string `json:"subnet_id"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+type trunkMappingJSON struct {
+	Subports []subportJSON `json:"subports"`
+}
+
+type subportJSON struct {
+	NetworkID      string `json:"network_id"`
+	SegmentationID int    `json:"segmentation_id"`
+}
+
+// NetworkMappingFlag implements pflag.Value so --network-mapping can be
+// passed once per VMware vNIC, each occurrence a JSON object mapping its
+// MAC address to a Neutron network/subnet/IP and optional trunk/allowed-
+// address-pair configuration.
+type NetworkMappingFlag struct {
+	Mappings map[string]NetworkMapping
+}
+
+// NewNetworkMappingFlag returns an empty NetworkMappingFlag ready to be
+// registered with a flag set via Var.
+func NewNetworkMappingFlag() *NetworkMappingFlag {
+	return &NetworkMappingFlag{Mappings: map[string]NetworkMapping{}}
+}
+
+func (f *NetworkMappingFlag) String() string {
+	return fmt.Sprintf("%d network mapping(s)", len(f.Mappings))
+}
+
+func (f *NetworkMappingFlag) Type() string {
+	return "networkMapping"
+}
+
+// Set parses one --network-mapping occurrence and adds it to Mappings,
+// keyed by its MAC address.
+func (f *NetworkMappingFlag) Set(value string) error {
+	var raw networkMappingJSON
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return fmt.Errorf("invalid network mapping: %w", err)
+	}
+
+	if raw.MACAddress == "" {
+		return fmt.Errorf("network mapping is missing mac_address")
+	}
+
+	networkID, err := uuid.Parse(raw.NetworkID)
+	if err != nil {
+		return fmt.Errorf("invalid network_id: %w", err)
+	}
+
+	mapping := NetworkMapping{NetworkID: networkID, FloatingPool: raw.FloatingPool}
+
+	if raw.SubnetID != "" {
+		subnetID, err := uuid.Parse(raw.SubnetID)
+		if err != nil {
+			return fmt.Errorf("invalid subnet_id: %w", err)
+		}
+		mapping.SubnetID = subnetID
+	}
+
+	if raw.IPAddress != "" {
+		ip, err := parseIP(raw.IPAddress)
+		if err != nil {
+			return err
+		}
+		mapping.IPAddress = ip
+	}
+
+	for _, extra := range raw.ExtraFixedIPs {
+		subnetID, err := uuid.Parse(extra.SubnetID)
+		if err != nil {
+			return fmt.Errorf("invalid extra_fixed_ips subnet_id: %w", err)
+		}
+
+		extraMapping := ExtraFixedIP{SubnetID: subnetID}
+		if extra.IPAddress != "" {
+			ip, err := parseIP(extra.IPAddress)
+			if err != nil {
+				return err
+			}
+			extraMapping.IPAddress = ip
+		}
+		mapping.ExtraFixedIPs = append(mapping.ExtraFixedIPs, extraMapping)
+	}
+
+	for _, cidr := range raw.AllowedAddressPairs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid allowed_address_pairs entry %q: %w", cidr, err)
+		}
+		mapping.AllowedAddressPairs = append(mapping.AllowedAddressPairs, *ipNet)
+	}
+
+	if raw.Trunk != nil {
+		trunk := &TrunkMapping{}
+		for _, subport := range raw.Trunk.Subports {
+			networkID, err := uuid.Parse(subport.NetworkID)
+			if err != nil {
+				return fmt.Errorf("invalid trunk subport network_id: %w", err)
+			}
+			trunk.Subports = append(trunk.Subports, Subport{
+				NetworkID:      networkID,
+				SegmentationID: subport.SegmentationID,
+			})
+		}
+		mapping.Trunk = trunk
+	}
+
+	f.Mappings[raw.MACAddress] = mapping
+	return nil
+}
+
+func parseIP(value string) (*net.IP, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", value)
+	}
+	return &ip, nil
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/pflag"
+
+	"github.com/vexxhost/migratekit/internal/openstack"
+)
+
+// serverCreateOptionsFlags holds the CLI-bound values backing
+// ServerCreateOptionsFromFlags. Reading them back lazily (rather than
+// building the openstack.ServerCreateOptions at registration time) respects
+// flag parsing order: flags are filled in by cobra before RunE executes.
+type serverCreateOptionsFlags struct {
+	keyPairName         string
+	userDataFile        string
+	availabilityZone    string
+	serverGroupID       string
+	volumeTypeByDiskKey map[string]string
+	metadata            map[string]string
+}
+
+var serverFlags serverCreateOptionsFlags
+
+// AddServerCreateOptionsFlags registers the instance-placement flags that
+// back ServerCreateOptionsFromFlags: keypair, cloud-init user-data,
+// availability zone, server group and per-disk volume type, for feature
+// parity with the Terraform OpenStack instance resource.
+func AddServerCreateOptionsFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&serverFlags.keyPairName, "key-pair", "", "Name of the Nova keypair to inject into migrated instances")
+	flags.StringVar(&serverFlags.userDataFile, "user-data-file", "", "Path to a cloud-init user-data script to run on first boot")
+	flags.StringVar(&serverFlags.availabilityZone, "availability-zone", "", "Nova availability zone to boot migrated instances in")
+	flags.StringVar(&serverFlags.serverGroupID, "server-group", "", "Nova server group ID for anti-affinity/affinity scheduler hints")
+	flags.StringToStringVar(&serverFlags.volumeTypeByDiskKey, "volume-type", nil, "Cinder volume type per VMware disk key (diskKey=volumeType); passed to Nova's block device mapping, which ignores it for already-migrated disks")
+	flags.StringToStringVar(&serverFlags.metadata, "server-metadata", nil, "Metadata key=value pairs to set on migrated instances")
+}
+
+// ServerCreateOptionsFromFlags builds an openstack.ServerCreateOptions from
+// the flags registered by AddServerCreateOptionsFlags and AddFloatingIPFlags.
+func ServerCreateOptionsFromFlags(networkMappings *NetworkMappingFlag) (openstack.ServerCreateOptions, error) {
+	opts := openstack.ServerCreateOptions{
+		KeyPairName:      serverFlags.keyPairName,
+		AvailabilityZone: serverFlags.availabilityZone,
+		ServerGroupID:    serverFlags.serverGroupID,
+		Metadata:         serverFlags.metadata,
+		FloatingIP:       FloatingIPConfigFromFlags(networkMappings),
+	}
+
+	if len(serverFlags.volumeTypeByDiskKey) > 0 {
+		opts.VolumeTypeByDiskKey = make(map[int32]string, len(serverFlags.volumeTypeByDiskKey))
+		for key, volumeType := range serverFlags.volumeTypeByDiskKey {
+			diskKey, err := strconv.ParseInt(key, 10, 32)
+			if err != nil {
+				return opts, fmt.Errorf("invalid disk key %q in --volume-type: %w", key, err)
+			}
+			opts.VolumeTypeByDiskKey[int32(diskKey)] = volumeType
+		}
+	}
+
+	if serverFlags.userDataFile != "" {
+		userData, err := os.ReadFile(serverFlags.userDataFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.UserData = userData
+	}
+
+	return opts, nil
+}
@@ -3,18 +3,25 @@ package openstack
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gophercloud/gophercloud/v2"
 	"github.com/gophercloud/gophercloud/v2/openstack"
 	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/extensions/keypairs"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/extensions/volumeattach"
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/allowedaddresspairs"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/trunks"
 	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/ports"
 	log "github.com/sirupsen/logrus"
 	"github.com/vexxhost/migratekit/cmd"
@@ -25,6 +32,133 @@ import (
 
 var ErrorVolumeNotFound = errors.New("volume not found")
 
+// EnvVolumeAPIVersion selects which Cinder API version NewClientSet binds
+// to: "auto" (default, prefer v3 and fall back to v2), "v2", or "v3".
+const EnvVolumeAPIVersion = "OS_VOLUME_API_VERSION"
+
+// EnvEndpointType selects which endpoint interface ("public", "internal" or
+// "admin") is looked up in the service catalog for every service client.
+const EnvEndpointType = "OS_ENDPOINT_TYPE"
+
+// endpointAvailabilityFromEnv maps OS_ENDPOINT_TYPE to the gophercloud
+// Availability used for service catalog lookups, defaulting to public.
+func endpointAvailabilityFromEnv() gophercloud.Availability {
+	switch strings.ToLower(os.Getenv(EnvEndpointType)) {
+	case "internal", "internalurl":
+		return gophercloud.AvailabilityInternal
+	case "admin", "adminurl":
+		return gophercloud.AvailabilityAdmin
+	default:
+		return gophercloud.AvailabilityPublic
+	}
+}
+
+// blockStorageAPIVersion describes one entry of the standard OpenStack
+// version discovery document returned by the Cinder apiversions endpoint.
+type blockStorageAPIVersion struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// usableBlockStorageStatuses are the apiversions statuses that mean the
+// version actually works against this cloud, as opposed to "EXPERIMENTAL"
+// or not being listed at all.
+var usableBlockStorageStatuses = map[string]bool{
+	"CURRENT":    true,
+	"SUPPORTED":  true,
+	"DEPRECATED": true,
+}
+
+// blockStorageAPIVersionAvailable probes the Cinder apiversions endpoint
+// (the unversioned root of client.Endpoint) and reports whether majorVersion
+// (e.g. "v3") is advertised as usable. Some private clouds publish a
+// volumev3 catalog entry that 404s or 5xxs in practice, which a catalog
+// lookup alone can't detect, so this hits the service directly.
+func blockStorageAPIVersionAvailable(ctx context.Context, provider *gophercloud.ProviderClient, client *gophercloud.ServiceClient, majorVersion string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blockStorageRootEndpoint(client.Endpoint), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := provider.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return false, fmt.Errorf("apiversions endpoint returned status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Versions []blockStorageAPIVersion `json:"versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return false, err
+	}
+
+	for _, v := range doc.Versions {
+		if strings.HasPrefix(v.ID, majorVersion) && usableBlockStorageStatuses[strings.ToUpper(v.Status)] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// blockStorageRootEndpoint strips the version and project-id path segments
+// off a bound block-storage endpoint (e.g. "https://host/v3/<project>/") to
+// get the unversioned root the apiversions document is served from.
+func blockStorageRootEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, segment := range segments {
+		if len(segment) > 1 && segment[0] == 'v' && segment[1] >= '0' && segment[1] <= '9' {
+			u.Path = strings.Join(append([]string{""}, segments[:i]...), "/") + "/"
+			break
+		}
+	}
+
+	return u.String()
+}
+
+// newBlockStorageClient binds a Cinder service client according to
+// OS_VOLUME_API_VERSION. In "auto" mode (the default) it probes the
+// apiversions endpoint and prefers v3, falling back to v2 when the cloud
+// doesn't actually serve it, even if the catalog lists it.
+func newBlockStorageClient(ctx context.Context, provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*gophercloud.ServiceClient, error) {
+	switch strings.ToLower(os.Getenv(EnvVolumeAPIVersion)) {
+	case "v2":
+		return openstack.NewBlockStorageV2(provider, eo)
+	case "v3":
+		return openstack.NewBlockStorageV3(provider, eo)
+	}
+
+	v3Client, err := openstack.NewBlockStorageV3(provider, eo)
+	if err != nil {
+		log.WithError(err).Warn("Cinder v3 endpoint not found in catalog, falling back to v2")
+		return openstack.NewBlockStorageV2(provider, eo)
+	}
+
+	supportsV3, err := blockStorageAPIVersionAvailable(ctx, provider, v3Client, "v3")
+	if err != nil {
+		log.WithError(err).Warn("Failed to probe Cinder apiversions endpoint, defaulting to v3")
+		return v3Client, nil
+	}
+
+	if supportsV3 {
+		return v3Client, nil
+	}
+
+	log.Info("Cinder apiversions endpoint does not advertise v3 as usable, falling back to v2")
+	return openstack.NewBlockStorageV2(provider, eo)
+}
+
 type ClientSet struct {
 	BlockStorage *gophercloud.ServiceClient
 	Compute      *gophercloud.ServiceClient
@@ -58,32 +192,31 @@ func NewClientSet(ctx context.Context) (*ClientSet, error) {
 		config.InsecureSkipVerify = true
 	}
 
-	provider.HTTPClient.Transport = &http.Transport{
+	provider.HTTPClient.Transport = newRetryTransport(&http.Transport{
 		TLSClientConfig: config,
-	}
+	})
 
 	err = openstack.Authenticate(ctx, provider, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	blockStorageClient, err := openstack.NewBlockStorageV3(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	eo := gophercloud.EndpointOpts{
+		Region:       os.Getenv("OS_REGION_NAME"),
+		Availability: endpointAvailabilityFromEnv(),
+	}
+
+	blockStorageClient, err := newBlockStorageClient(ctx, provider, eo)
 	if err != nil {
 		return nil, err
 	}
 
-	computeClient, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	computeClient, err := openstack.NewComputeV2(provider, eo)
 	if err != nil {
 		return nil, err
 	}
 
-	networkingClient, err := openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	networkingClient, err := openstack.NewNetworkV2(provider, eo)
 	if err != nil {
 		return nil, err
 	}
@@ -162,6 +295,53 @@ func (c *ClientSet) GetVolumeListForDiskOld(ctx context.Context, vm *object.Virt
 	return volumeList, err
 }
 
+// ErrorVolumeAttachedElsewhere is returned by AttachVolumesToExistingServer
+// when a migrated volume is already attached to a server other than the
+// requested target, so the caller can decide whether to detach or abort.
+var ErrorVolumeAttachedElsewhere = errors.New("volume already attached to a different server")
+
+// AttachVolumesToExistingServer attaches each of the VM's migrated Cinder
+// volumes, in disk order, to an already-provisioned Nova server instead of
+// booting a new one. This supports reattach/re-run workflows, e.g. a prior
+// boot failed, or the disks are being migrated into a pre-provisioned
+// "shell" VM that already carries the desired keypair/user-data/AZ. It is
+// idempotent: a volume already attached to serverID is left alone, and one
+// attached elsewhere is reported via ErrorVolumeAttachedElsewhere.
+func (c *ClientSet) AttachVolumesToExistingServer(ctx context.Context, vm *object.VirtualMachine, serverID string) error {
+	devices, err := vm.Device(context.Background())
+	if err != nil {
+		return err
+	}
+
+	disks := devices.SelectByType((*types.VirtualDisk)(nil))
+	for _, disk := range disks {
+		vd := disk.(*types.VirtualDisk)
+		volume, err := c.GetVolumeForDisk(ctx, vm, vd)
+		if err != nil {
+			return err
+		}
+
+		if len(volume.Attachments) > 0 {
+			attachedTo := volume.Attachments[0].ServerID
+			if attachedTo == serverID {
+				log.WithFields(log.Fields{"volume": volume.ID, "server": serverID}).Info("Volume already attached to target server")
+				continue
+			}
+			return fmt.Errorf("%w: volume %s is attached to server %s", ErrorVolumeAttachedElsewhere, volume.ID, attachedTo)
+		}
+
+		_, err = volumeattach.Create(ctx, c.Compute, serverID, volumeattach.CreateOpts{
+			VolumeID: volume.ID,
+		}).Extract()
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"volume": volume.ID, "server": serverID}).Info("Volume attached")
+	}
+
+	return nil
+}
+
 func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *object.VirtualMachine, networkMappings *cmd.NetworkMappingFlag) ([]servers.Network, error) {
 	devices, err := vm.Device(context.Background())
 	if err != nil {
@@ -207,12 +387,18 @@ func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *object
 
 			unmanaged := mapping.SubnetID == uuid.Nil
 			if !unmanaged {
-				var ips []ports.IP
-				if mapping.IPAddress == nil {
-					ips = []ports.IP{{SubnetID: mapping.SubnetID.String()}}
-				} else {
-					ips = []ports.IP{{SubnetID: mapping.SubnetID.String(), IPAddress: mapping.IPAddress.String()}}
+				ips := []ports.IP{{SubnetID: mapping.SubnetID.String()}}
+				if mapping.IPAddress != nil {
+					ips[0].IPAddress = mapping.IPAddress.String()
+				}
+				for _, extra := range mapping.ExtraFixedIPs {
+					ip := ports.IP{SubnetID: extra.SubnetID.String()}
+					if extra.IPAddress != nil {
+						ip.IPAddress = extra.IPAddress.String()
+					}
+					ips = append(ips, ip)
 				}
+
 				opts := ctx.Value("portCreateOpts").(*PortCreateOpts)
 				createOpts.FixedIPs = ips
 				createOpts.SecurityGroups = opts.SecurityGroups
@@ -220,7 +406,19 @@ func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *object
 				createOpts.Description = card.GetVirtualEthernetCard().DeviceInfo.GetDescription().Summary
 			}
 
-			port, err = ports.Create(ctx, c.Networking, createOpts).Extract()
+			var createOptsBuilder ports.CreateOptsBuilder = createOpts
+			if len(mapping.AllowedAddressPairs) > 0 {
+				pairs := make([]ports.AddressPair, 0, len(mapping.AllowedAddressPairs))
+				for _, cidr := range mapping.AllowedAddressPairs {
+					pairs = append(pairs, ports.AddressPair{IPAddress: cidr.String()})
+				}
+				createOptsBuilder = allowedaddresspairs.CreateOptsExt{
+					CreateOptsBuilder:   createOptsBuilder,
+					AllowedAddressPairs: pairs,
+				}
+			}
+
+			port, err = ports.Create(ctx, c.Networking, createOptsBuilder).Extract()
 			if err != nil {
 				return nil, err
 			}
@@ -232,13 +430,155 @@ func (c *ClientSet) EnsurePortsForVirtualMachine(ctx context.Context, vm *object
 			return nil, errors.New("multiple ports found")
 		}
 
+		if mapping.Trunk != nil {
+			if err := c.ensureTrunkForPort(ctx, port.ID, mapping.Trunk); err != nil {
+				return nil, err
+			}
+		}
+
 		networks = append(networks, servers.Network{Port: port.ID})
 	}
 
 	return networks, nil
 }
 
-func (c *ClientSet) CreateResourcesForVirtualMachine(ctx context.Context, vm *object.VirtualMachine, flavor string, networks []servers.Network) error {
+// ensureSubportPort creates (or reuses) the Neutron port a trunk subport
+// attaches to on networkID, scoped to parentPortID. A trunk's subport_id
+// must reference an actual port on that network, not the network itself,
+// and a port can be a subport of only one trunk at a time — VLAN networks
+// are typically shared across many migrated VMs, so the port is named off
+// both the parent trunk port and the VLAN network, not the network alone,
+// to avoid colliding with another VM's subport on the same VLAN.
+func (c *ClientSet) ensureSubportPort(ctx context.Context, parentPortID string, networkID string) (*ports.Port, error) {
+	name := fmt.Sprintf("migratekit-trunk-subport-%s-%s", parentPortID, networkID)
+
+	pages, err := ports.List(c.Networking, ports.ListOpts{NetworkID: networkID, Name: name}).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	portList, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(portList) == 1 {
+		log.WithFields(log.Fields{"port": portList[0].ID, "network": networkID, "parent_port": parentPortID}).Info("Trunk subport port already exists")
+		return &portList[0], nil
+	} else if len(portList) > 1 {
+		return nil, errors.New("multiple trunk subport ports found for parent port and network")
+	}
+
+	port, err := ports.Create(ctx, c.Networking, ports.CreateOpts{
+		NetworkID: networkID,
+		Name:      name,
+	}).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"port": port.ID, "network": networkID, "parent_port": parentPortID}).Info("Trunk subport port created")
+	return port, nil
+}
+
+// ensureTrunkForPort creates a Neutron trunk on parent port portID if one
+// does not already exist, then reconciles its subports against trunkCfg so
+// that VMware tagged port groups (multiple VLANs on one vNIC) map onto a
+// single Neutron trunk port with one subport per VLAN.
+func (c *ClientSet) ensureTrunkForPort(ctx context.Context, portID string, trunkCfg *cmd.TrunkMapping) error {
+	pages, err := trunks.List(c.Networking, trunks.ListOpts{PortID: portID}).AllPages(ctx)
+	if err != nil {
+		return err
+	}
+
+	trunkList, err := trunks.ExtractTrunks(pages)
+	if err != nil {
+		return err
+	}
+
+	wantedSubports := make([]trunks.Subport, 0, len(trunkCfg.Subports))
+	for _, subport := range trunkCfg.Subports {
+		subportPort, err := c.ensureSubportPort(ctx, portID, subport.NetworkID.String())
+		if err != nil {
+			return err
+		}
+
+		wantedSubports = append(wantedSubports, trunks.Subport{
+			PortID:           subportPort.ID,
+			SegmentationID:   subport.SegmentationID,
+			SegmentationType: "vlan",
+		})
+	}
+
+	var trunk *trunks.Trunk
+	if len(trunkList) == 0 {
+		trunk, err = trunks.Create(ctx, c.Networking, trunks.CreateOpts{
+			PortID:   portID,
+			Subports: wantedSubports,
+		}).Extract()
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"trunk": trunk.ID, "port": portID}).Info("Trunk created")
+		return nil
+	} else if len(trunkList) > 1 {
+		return errors.New("multiple trunks found for port")
+	}
+
+	trunk = &trunkList[0]
+	existing := make(map[string]bool, len(trunk.Subports))
+	for _, subport := range trunk.Subports {
+		existing[subport.PortID] = true
+	}
+
+	var missing []trunks.Subport
+	for _, subport := range wantedSubports {
+		if !existing[subport.PortID] {
+			missing = append(missing, subport)
+		}
+	}
+
+	if len(missing) == 0 {
+		log.WithFields(log.Fields{"trunk": trunk.ID, "port": portID}).Info("Trunk already up to date")
+		return nil
+	}
+
+	_, err = trunks.AddSubports(ctx, c.Networking, trunk.ID, trunks.AddSubportsOpts{Subports: missing}).Extract()
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"trunk": trunk.ID, "port": portID, "subports_added": len(missing)}).Info("Trunk subports added")
+	return nil
+}
+
+// ServerCreateOptions carries the instance-level settings that the
+// Terraform OpenStack instance resource exposes and that migrated VMs need
+// for feature parity: the injected SSH key, a cloud-init script standing in
+// for guest customization now that the source is VMware, placement (AZ and
+// anti-affinity/server-group scheduler hints), free-form metadata, and
+// floating IP allocation. It is populated from CLI flags in cmd and passed
+// through to CreateResourcesForVirtualMachine.
+type ServerCreateOptions struct {
+	KeyPairName      string
+	UserData         []byte
+	AvailabilityZone string
+	Metadata         map[string]string
+	ServerGroupID    string
+
+	// VolumeTypeByDiskKey maps a VMware virtual disk's device key (as used
+	// in GetVolumeForDisk's volume metadata) to the Cinder volume type it
+	// should be created with. Nova's block-device-mapping API only honors
+	// volume_type when it has to create the volume itself (source_type
+	// image/blank/snapshot); CreateResourcesForVirtualMachine always boots
+	// from volumes that were already migrated (source_type=volume), so this
+	// has no effect there. Nothing else in this package reads it, so it does
+	// not change the type of any volume.
+	VolumeTypeByDiskKey map[int32]string
+
+	FloatingIP FloatingIPConfig
+}
+
+func (c *ClientSet) CreateResourcesForVirtualMachine(ctx context.Context, vm *object.VirtualMachine, flavor string, networks []servers.Network, opts ServerCreateOptions) error {
 	var o mo.VirtualMachine
 	err := vm.Properties(ctx, vm.Reference(), []string{"config"}, &o)
 	if err != nil {
@@ -265,16 +605,29 @@ func (c *ClientSet) CreateResourcesForVirtualMachine(ctx context.Context, vm *ob
 			SourceType:      servers.SourceVolume,
 			UUID:            volume.ID,
 			DestinationType: servers.DestinationVolume,
+			// Ignored by Nova for SourceVolume; see VolumeTypeByDiskKey's
+			// doc comment.
+			VolumeType: opts.VolumeTypeByDiskKey[vd.Key],
 		})
 		diskIndex++
 	}
 
-	server, err := servers.Create(ctx, c.Compute, servers.CreateOpts{
-		Name:        o.Config.Name,
-		FlavorRef:   flavor,
-		Networks:    networks,
-		BlockDevice: blockDevices,
-	}, servers.SchedulerHintOpts{}).Extract()
+	createOpts := keypairs.CreateOptsExt{
+		CreateOptsBuilder: servers.CreateOpts{
+			Name:             o.Config.Name,
+			FlavorRef:        flavor,
+			Networks:         networks,
+			BlockDevice:      blockDevices,
+			UserData:         opts.UserData,
+			AvailabilityZone: opts.AvailabilityZone,
+			Metadata:         opts.Metadata,
+		},
+		KeyName: opts.KeyPairName,
+	}
+
+	server, err := servers.Create(ctx, c.Compute, createOpts, servers.SchedulerHintOpts{
+		Group: opts.ServerGroupID,
+	}).Extract()
 	if err != nil {
 		return err
 	}
@@ -287,5 +640,16 @@ func (c *ClientSet) CreateResourcesForVirtualMachine(ctx context.Context, vm *ob
 		return err
 	}
 
+	for _, network := range networks {
+		port, err := ports.Get(ctx, c.Networking, network.Port).Extract()
+		if err != nil {
+			return err
+		}
+
+		if _, err := c.EnsureFloatingIPForPort(ctx, port.ID, port.NetworkID, vm.Reference().Value, opts.FloatingIP); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
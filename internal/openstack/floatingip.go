@@ -0,0 +1,167 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/attributestags"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/networks"
+)
+
+// floatingIPVMTag tags a floating IP with the source VM it was carried
+// over from, so a later run can find and reassociate it instead of
+// allocating a fresh address. This is how migrated instances keep the
+// public IP their original VMware/NSX edge served, across reattach runs.
+const floatingIPVMTagPrefix = "migratekit-vm-"
+
+func floatingIPVMTag(vmID string) string {
+	return floatingIPVMTagPrefix + vmID
+}
+
+// FloatingIPConfig controls whether, and from which pool, migrated
+// instances get a floating IP associated to their ports. DefaultPool is
+// used when a network mapping does not name its own PoolByNetwork entry.
+// Reconciliation is idempotent: a port that already has a floating IP
+// bound is left untouched.
+type FloatingIPConfig struct {
+	Enabled       bool
+	DefaultPool   string
+	PoolByNetwork map[string]string
+}
+
+// poolForNetwork resolves the floating IP pool to use for a port created
+// against networkID, preferring a per-network override over the default.
+func (f *FloatingIPConfig) poolForNetwork(networkID string) string {
+	if pool, ok := f.PoolByNetwork[networkID]; ok && pool != "" {
+		return pool
+	}
+	return f.DefaultPool
+}
+
+// EnsureFloatingIPForPort allocates and associates a floating IP to portID
+// out of the pool configured for networkID. It is idempotent: a floating IP
+// already bound to the port is left alone, and one already tagged for vmID
+// (carried over from a previous run against the source VM, e.g. the address
+// it held on the original VMware/NSX edge) is reassociated rather than a
+// new one allocated. It returns nil, nil when floating IPs are disabled or
+// no pool is configured for the network.
+func (c *ClientSet) EnsureFloatingIPForPort(ctx context.Context, portID string, networkID string, vmID string, config FloatingIPConfig) (*floatingips.FloatingIP, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	pool := config.poolForNetwork(networkID)
+	if pool == "" {
+		return nil, nil
+	}
+
+	pages, err := floatingips.List(c.Networking, floatingips.ListOpts{PortID: portID}).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := floatingips.ExtractFloatingIPs(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(existing) == 1 {
+		log.WithFields(log.Fields{"floating_ip": existing[0].FloatingIP, "port": portID}).Info("Floating IP already associated")
+		return &existing[0], nil
+	} else if len(existing) > 1 {
+		return nil, errors.New("multiple floating IPs found for port")
+	}
+
+	poolID, err := floatingNetworkIDByName(ctx, c.Networking, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	reused, err := c.reuseTaggedFloatingIP(ctx, poolID, vmID, portID)
+	if err != nil {
+		return nil, err
+	}
+	if reused != nil {
+		return reused, nil
+	}
+
+	fip, err := floatingips.Create(ctx, c.Networking, floatingips.CreateOpts{
+		FloatingNetworkID: poolID,
+		PortID:            portID,
+	}).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	tag := floatingIPVMTag(vmID)
+	if _, err := attributestags.ReplaceAll(ctx, c.Networking, "floatingips", fip.ID, attributestags.ReplaceAllOpts{Tags: []string{tag}}).Extract(); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"floating_ip": fip.FloatingIP, "port": portID}).Info("Floating IP allocated")
+	return fip, nil
+}
+
+// reuseTaggedFloatingIP looks for a floating IP in poolID tagged for vmID
+// that isn't already bound to a port, and associates it with portID if
+// found, so a migrated instance keeps its original public address instead
+// of being handed a fresh one.
+func (c *ClientSet) reuseTaggedFloatingIP(ctx context.Context, poolID string, vmID string, portID string) (*floatingips.FloatingIP, error) {
+	tag := floatingIPVMTag(vmID)
+
+	pages, err := floatingips.List(c.Networking, floatingips.ListOpts{
+		FloatingNetworkID: poolID,
+		Tags:              tag,
+	}).AllPages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tagged, err := floatingips.ExtractFloatingIPs(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range tagged {
+		if tagged[i].PortID != "" {
+			continue
+		}
+
+		fip, err := floatingips.Update(ctx, c.Networking, tagged[i].ID, floatingips.UpdateOpts{PortID: &portID}).Extract()
+		if err != nil {
+			return nil, err
+		}
+
+		log.WithFields(log.Fields{"floating_ip": fip.FloatingIP, "port": portID}).Info("Reused floating IP tagged for source VM")
+		return fip, nil
+	}
+
+	return nil, nil
+}
+
+// floatingNetworkIDByName resolves an external network name (the "floating
+// pool") to its network ID, the same name Neutron is configured with.
+func floatingNetworkIDByName(ctx context.Context, client *gophercloud.ServiceClient, name string) (string, error) {
+	pages, err := networks.List(client, networks.ListOpts{Name: name}).AllPages(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	networkList, err := networks.ExtractNetworks(pages)
+	if err != nil {
+		return "", err
+	}
+
+	if len(networkList) == 0 {
+		return "", fmt.Errorf("floating IP pool network not found: %s", name)
+	} else if len(networkList) > 1 {
+		return "", fmt.Errorf("multiple networks found for floating IP pool: %s", name)
+	}
+
+	return networkList[0].ID, nil
+}
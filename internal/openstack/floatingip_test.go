@@ -0,0 +1,38 @@
+package openstack
+
+import "testing"
+
+func TestFloatingIPConfigPoolForNetwork(t *testing.T) {
+	config := FloatingIPConfig{
+		DefaultPool: "public",
+		PoolByNetwork: map[string]string{
+			"net-a": "public-a",
+			"net-b": "",
+		},
+	}
+
+	tests := []struct {
+		name      string
+		networkID string
+		want      string
+	}{
+		{"network with override", "net-a", "public-a"},
+		{"network with empty override falls back to default", "net-b", "public"},
+		{"network with no entry falls back to default", "net-c", "public"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := config.poolForNetwork(tt.networkID); got != tt.want {
+				t.Errorf("poolForNetwork(%q) = %q, want %q", tt.networkID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFloatingIPConfigPoolForNetworkNoDefault(t *testing.T) {
+	config := FloatingIPConfig{}
+	if got := config.poolForNetwork("net-a"); got != "" {
+		t.Errorf("poolForNetwork with no config = %q, want empty", got)
+	}
+}
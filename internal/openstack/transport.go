@@ -0,0 +1,159 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// EnvAPIRateLimit sets the steady-state request rate, in requests per
+// second, applied to every OpenStack API call. Unset or non-positive
+// disables rate limiting.
+const EnvAPIRateLimit = "OS_API_RATE_LIMIT"
+
+// EnvAPIBurst sets the token-bucket burst size paired with
+// EnvAPIRateLimit. Defaults to 1 when unset.
+const EnvAPIBurst = "OS_API_BURST"
+
+const (
+	maxRetries  = 5
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
+
+// retryTransport wraps an http.RoundTripper with exponential backoff and
+// jitter on 429/502/503/504 and transient network errors, honoring
+// Retry-After, plus an optional token-bucket rate limit. Large migrations
+// otherwise hammer Cinder with a volumes.List per disk and Nova with status
+// polling, and trip provider-side quotas; centralizing retry/backoff here
+// avoids scattering it across every call site.
+type retryTransport struct {
+	next    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+// newRetryTransport wraps next with retry/backoff, and with a rate limiter
+// when OS_API_RATE_LIMIT is set to a positive value.
+func newRetryTransport(next http.RoundTripper) *retryTransport {
+	t := &retryTransport{next: next}
+
+	limit, err := strconv.ParseFloat(os.Getenv(EnvAPIRateLimit), 64)
+	if err != nil || limit <= 0 {
+		return t
+	}
+
+	burst, err := strconv.Atoi(os.Getenv(EnvAPIBurst))
+	if err != nil || burst <= 0 {
+		burst = 1
+	}
+
+	t.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+	return t
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.limiter != nil {
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errors.New("cannot retry request: body is not rewindable")
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, bodyErr
+			}
+			req.Body = body
+		}
+
+		resp, err = t.next.RoundTrip(req)
+		if !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		if attempt == maxRetries {
+			break
+		}
+
+		wait := retryAfter(resp)
+		if wait == 0 {
+			wait = backoffWithJitter(attempt)
+		}
+
+		log.WithFields(log.Fields{"attempt": attempt + 1, "wait": wait, "url": req.URL.String()}).Warn("Retrying OpenStack API request")
+
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	return resp, err
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter returns the wait time from a Retry-After header, or zero if
+// absent or unparseable.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when)
+	}
+
+	return 0
+}
+
+// backoffWithJitter returns an exponential backoff delay for the given
+// zero-indexed attempt, capped at maxBackoff and randomized by up to 50%
+// to avoid synchronized retries across concurrent requests.
+func backoffWithJitter(attempt int) time.Duration {
+	delay := time.Duration(float64(baseBackoff) * math.Pow(2, float64(attempt)))
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay/2 + jitter
+}
@@ -0,0 +1,123 @@
+package openstack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{"too many requests", http.StatusTooManyRequests, nil, true},
+		{"bad gateway", http.StatusBadGateway, nil, true},
+		{"service unavailable", http.StatusServiceUnavailable, nil, true},
+		{"gateway timeout", http.StatusGatewayTimeout, nil, true},
+		{"ok", http.StatusOK, nil, false},
+		{"not found", http.StatusNotFound, nil, false},
+		{"context canceled", 0, context.Canceled, false},
+		{"transient network error", 0, errors.New("connection reset"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+
+			if got := shouldRetry(resp, tt.err); got != tt.want {
+				t.Errorf("shouldRetry(%d, %v) = %v, want %v", tt.status, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	seconds := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	if got := retryAfter(seconds); got != 2*time.Second {
+		t.Errorf("retryAfter(seconds) = %v, want 2s", got)
+	}
+
+	if got := retryAfter(&http.Response{Header: http.Header{}}); got != 0 {
+		t.Errorf("retryAfter(no header) = %v, want 0", got)
+	}
+
+	if got := retryAfter(nil); got != 0 {
+		t.Errorf("retryAfter(nil) = %v, want 0", got)
+	}
+}
+
+func TestBackoffWithJitterIsBounded(t *testing.T) {
+	for attempt := 0; attempt < 8; attempt++ {
+		delay := backoffWithJitter(attempt)
+		if delay < 0 || delay > maxBackoff {
+			t.Fatalf("backoffWithJitter(%d) = %v, want within [0, %v]", attempt, delay, maxBackoff)
+		}
+
+		upperBound := baseBackoff << attempt
+		if upperBound > maxBackoff {
+			upperBound = maxBackoff
+		}
+		if delay > upperBound {
+			t.Fatalf("backoffWithJitter(%d) = %v, want <= %v", attempt, delay, upperBound)
+		}
+	}
+}
+
+// TestRetryTransportRewindsBody verifies that a request body is resent in
+// full on a retried attempt instead of the drained, now-empty body from the
+// first attempt.
+func TestRetryTransportRewindsBody(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("reading request body: %v", err)
+		}
+
+		if string(body) != "payload" {
+			t.Errorf("attempt %d: got body %q, want %q", atomic.LoadInt32(&attempts), body, "payload")
+		}
+
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport)}
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString("payload"))
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("final status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Errorf("server saw %d attempts, want 2", got)
+	}
+}